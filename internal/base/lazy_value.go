@@ -7,15 +7,17 @@ package base
 import "context"
 
 // A value can have user-defined attributes that are a function of the value
-// byte slice. For now, we only support "short attributes", which can be
-// encoded in 3 bits. We will likely extend this to "long attributes" later
-// for values that are even more expensive to access than those in value
-// blocks in the same sstable.
+// byte slice. We support two kinds: "short attributes", which are encoded in
+// 3 bits and are cheap enough to store inline with AttributeAndLen, and
+// "long attributes", up to MaxLongAttributeLen bytes, for values that are
+// even more expensive to access than those in value blocks in the same
+// sstable (e.g. values stored in separate blob files).
 //
 // When a sstable writer chooses not to store a value together with the key,
-// it can call the ShortAttributeExtractor to extract the attribute and store
-// it together with the key. This allows for cheap retrieval of
-// AttributeAndLen on the read-path, without doing a more expensive retrieval
+// it can call the ShortAttributeExtractor and/or LongAttributeExtractor to
+// extract the attribute(s) and store them together with the key. This
+// allows for cheap retrieval of AttributeAndLen (and, if configured, the
+// LongAttribute) on the read-path, without doing a more expensive retrieval
 // of the value. In general, the extraction code may want to also look at the
 // key to decide how to treat the value, hence the key* parameters.
 //
@@ -44,6 +46,50 @@ type AttributeAndLen struct {
 	ShortAttribute ShortAttribute
 }
 
+// MaxLongAttributeLen is the maximum length, in bytes, of a LongAttribute.
+const MaxLongAttributeLen = 32
+
+// LongAttribute is a user-specified attribute of a value that is too
+// expensive to encode in the 3 bits available to ShortAttribute, but is
+// still worth storing adjacent to the key so that it can be inspected
+// without fetching the value itself. The motivating use case is CockroachDB
+// MVCC metadata (timestamp, tombstone bit, intent bit, value length), which
+// lets pebbleMVCCScanner filter by timestamp without ever issuing a blob
+// fetch. A LongAttribute must be at most MaxLongAttributeLen bytes.
+type LongAttribute []byte
+
+// LongAttributeExtractor is an extractor that given the value, will return
+// the LongAttribute. It is invoked at the same point in the write path as
+// ShortAttributeExtractor (see the comment at the top of this file), and is subject to
+// the same write-path performance caveats. Implementations must return a
+// slice of at most MaxLongAttributeLen bytes.
+type LongAttributeExtractor func(
+	key []byte, keyPrefixLen int, value []byte) (LongAttribute, error)
+
+// ExtractLongAttribute runs extractor, if non-nil, over value and validates
+// the result against MaxLongAttributeLen. It is the single entry point a
+// writer should use to populate LazyFetcher.LongAttribute, so that "no
+// extractor configured" and "extractor configured but returned an empty
+// attribute" are always kept distinct: the returned configured bool is false
+// in the former case and true in the latter, mirroring what
+// LazyValue.TryGetLongAttribute later reports to readers.
+func ExtractLongAttribute(
+	extractor LongAttributeExtractor, key []byte, keyPrefixLen int, value []byte,
+) (attr LongAttribute, configured bool, err error) {
+	if extractor == nil {
+		return nil, false, nil
+	}
+	attr, err = extractor(key, keyPrefixLen, value)
+	if err != nil {
+		return nil, true, err
+	}
+	if len(attr) > MaxLongAttributeLen {
+		return nil, true, AssertionFailedf(
+			"long attribute of length %d exceeds MaxLongAttributeLen %d", len(attr), MaxLongAttributeLen)
+	}
+	return attr, true, nil
+}
+
 // LazyValue represents a value that may not already have been extracted.
 // Currently, it can represent either an in-place value (stored with the key)
 // or a value stored in the value section. However, the interface is general
@@ -166,6 +212,45 @@ type LazyFetcher struct {
 	// BlobFileID identifies the blob file containing the value. It is only
 	// populated if the value is stored in a blob file.
 	BlobFileID BlobFileID
+	// LongAttribute is populated if the writer was configured with a
+	// LongAttributeExtractor and chose to store this value out-of-line. It is
+	// nil if no LongAttributeExtractor was configured, or the value was
+	// stored in-place (in which case the caller can cheaply compute the
+	// attribute from the value itself). A nil LongAttribute is ambiguous on
+	// its own -- see LongAttributeConfigured.
+	LongAttribute LongAttribute
+	// LongAttributeConfigured records whether a LongAttributeExtractor was
+	// actually run to produce LongAttribute (via ExtractLongAttribute), as
+	// opposed to LongAttribute simply being the zero value because no
+	// extractor was configured for this sstable. Without this, a caller like
+	// pebbleMVCCScanner filtering on LongAttribute cannot tell "trust this
+	// empty attribute" apart from "no one ever computed one, fetch the value
+	// instead".
+	LongAttributeConfigured bool
+	// withValueRunning is set for the duration of a LazyValue.WithValue call
+	// that uses this fetcher, to detect and reject reentrant calls (see
+	// ErrLazyValueReentrantWithValue).
+	withValueRunning bool
+	// prefetched, if non-nil, holds a value already fetched on the caller's
+	// behalf via ValueFetcher.PrefetchHandles, making the next Value or
+	// WithValue call synchronous. Set through SetPrefetched, since
+	// ValueFetcher implementations (e.g. a blob-file fetcher) necessarily
+	// live outside package base. It lives here, rather than on LazyValue
+	// itself, to stay within LazyValue's 32-byte sizeof budget. A cloned
+	// LazyValue does not inherit a prefetched slice: Clone always populates a
+	// fresh LazyFetcher, so the prefetched value's lifetime stays tied to the
+	// LazyFetcher (and therefore the iterator) that actually fetched it.
+	prefetched []byte
+}
+
+// SetPrefetched records val as already fetched for this LazyFetcher, so that
+// the next LazyValue.Value or LazyValue.WithValue call using it is
+// synchronous. PrefetchHandles does not call it: a PrefetchRequest does not
+// reference a LazyFetcher, so whoever holds the LazyFetcher calls
+// SetPrefetched once a prefetch for the corresponding handle has completed.
+// val must remain valid for as long as the LazyFetcher is in use.
+func (f *LazyFetcher) SetPrefetched(val []byte) {
+	f.prefetched = val
 }
 
 // ValueFetcher is an interface for fetching a value.
@@ -184,6 +269,41 @@ type ValueFetcher interface {
 	FetchHandle(
 		ctx context.Context, handle []byte, blobFileID BlobFileID, valLen uint32, buf []byte,
 	) (val []byte, callerOwned bool, err error)
+
+	// WithHandle is a zero-copy variant of FetchHandle: instead of returning
+	// the value, it invokes fn with it. For an in-place value this can be a
+	// direct slice of the underlying block; for a value that must be fetched
+	// (e.g. from a blob file), the implementation can pin the backing cache
+	// entry for the duration of fn and release it on return, avoiding the
+	// allocation/copy that FetchHandle incurs when P2 (see the LazyValue
+	// comment) cannot be satisfied.
+	//
+	// val passed to fn must not escape fn: it may become invalid as soon as
+	// fn returns. Implementations must reject reentrant calls, i.e. a call to
+	// WithHandle (or any iterator positioning method that would invalidate
+	// val) made from within fn, by returning an error rather than corrupting
+	// or use-after-freeing val.
+	WithHandle(
+		ctx context.Context, handle []byte, blobFileID BlobFileID, valLen uint32,
+		fn func(val []byte) error,
+	) error
+
+	// PrefetchHandles requests that the values for reqs be fetched ahead of a
+	// future FetchHandle/WithHandle call for the same handles, and warmed
+	// into the block cache where applicable. Implementations are encouraged
+	// to coalesce requests that land in the same blob file into a single I/O.
+	// PrefetchHandles must not block waiting for the fetches to complete --
+	// it merely starts or schedules them -- and implementations that cannot
+	// usefully prefetch may treat it as a no-op.
+	PrefetchHandles(ctx context.Context, reqs []PrefetchRequest) error
+}
+
+// PrefetchRequest identifies a single value, by handle, to be prefetched via
+// ValueFetcher.PrefetchHandles.
+type PrefetchRequest struct {
+	Handle     []byte
+	BlobFileID BlobFileID
+	ValueLen   uint32
 }
 
 // Value returns the underlying value.
@@ -192,10 +312,45 @@ func (lv *LazyValue) Value(buf []byte) (val []byte, callerOwned bool, err error)
 	if f == nil {
 		return lv.ValueOrHandle, false, nil
 	}
+	if f.prefetched != nil {
+		return f.prefetched, false, nil
+	}
 	return f.Fetcher.FetchHandle(context.TODO(),
 		lv.ValueOrHandle, f.BlobFileID, f.Attribute.ValueLen, buf)
 }
 
+// WithValue is a zero-copy variant of Value: instead of returning the value,
+// it invokes fn with it, avoiding the allocation/copy that Value incurs for
+// fetched (as opposed to in-place) values. The slice passed to fn must not
+// escape the call to fn -- it may point directly into iterator- or
+// cache-owned memory that becomes invalid as soon as fn returns.
+//
+// The existing Value(buf) API should still be used by callers that need to
+// retain the bytes; WithValue is an escape hatch for hot paths (e.g. MVCC
+// scans, compactions merging values) that consume the value entirely within
+// fn and would otherwise pay for a copy they don't need.
+//
+// Calling WithValue reentrantly from within fn, on a LazyValue using the same
+// LazyFetcher, returns ErrLazyValueReentrantWithValue instead of corrupting
+// the in-flight val. WithValue does not itself detect a call from within fn
+// that repositions the iterator owning lv, and an in-place value (nil
+// Fetcher) has no guard at all.
+func (lv *LazyValue) WithValue(ctx context.Context, fn func(val []byte) error) error {
+	f := lv.Fetcher
+	if f == nil {
+		return fn(lv.ValueOrHandle)
+	}
+	if f.withValueRunning {
+		return ErrLazyValueReentrantWithValue
+	}
+	f.withValueRunning = true
+	defer func() { f.withValueRunning = false }()
+	if f.prefetched != nil {
+		return fn(f.prefetched)
+	}
+	return f.Fetcher.WithHandle(ctx, lv.ValueOrHandle, f.BlobFileID, f.Attribute.ValueLen, fn)
+}
+
 // Len returns the length of the value.
 func (lv *LazyValue) Len() int {
 	if lv.Fetcher == nil {
@@ -213,6 +368,20 @@ func (lv *LazyValue) TryGetShortAttribute() (ShortAttribute, bool) {
 	return lv.Fetcher.Attribute.ShortAttribute, true
 }
 
+// TryGetLongAttribute returns the LongAttribute and a bool indicating
+// whether a LongAttributeExtractor was actually configured and run for this
+// value. Unlike TryGetShortAttribute, a true ok does not imply a non-empty
+// attribute: the writer's LongAttributeExtractor may legitimately have
+// returned a zero-length LongAttribute. But a false ok means no extractor
+// ran at all, so the returned LongAttribute must not be trusted -- the
+// caller has to fetch the value to learn anything about it.
+func (lv *LazyValue) TryGetLongAttribute() (LongAttribute, bool) {
+	if lv.Fetcher == nil {
+		return nil, false
+	}
+	return lv.Fetcher.LongAttribute, lv.Fetcher.LongAttributeConfigured
+}
+
 // Clone creates a stable copy of the LazyValue, by appending bytes to buf.
 // The fetcher parameter must be non-nil and may be over-written and used
 // inside the returned LazyValue -- this is needed to avoid an allocation.
@@ -220,7 +389,9 @@ func (lv *LazyValue) TryGetShortAttribute() (ShortAttribute, bool) {
 // they can have a pool of exactly K LazyFetcher structs they can reuse in
 // these calls. The alternative of allocating LazyFetchers from a sync.Pool is
 // not viable since we have no code trigger for returning to the pool
-// (LazyValues are simply GC'd).
+// (LazyValues are simply GC'd). LazyFetcherPool below provides a first-class
+// version of this hard-coded pool, for owners (such as Iterator) that do
+// have a trigger -- repositioning or closing -- on which to reclaim fetchers.
 //
 // NB: It is highly preferable that LazyValue.Value() has not been called,
 // since the Clone will forget any previously extracted value, and a future
@@ -237,9 +408,11 @@ func (lv *LazyValue) Clone(buf []byte, fetcher *LazyFetcher) (LazyValue, []byte)
 	var lvCopy LazyValue
 	if lv.Fetcher != nil {
 		*fetcher = LazyFetcher{
-			Fetcher:    lv.Fetcher.Fetcher,
-			Attribute:  lv.Fetcher.Attribute,
-			BlobFileID: lv.Fetcher.BlobFileID,
+			Fetcher:                 lv.Fetcher.Fetcher,
+			Attribute:               lv.Fetcher.Attribute,
+			BlobFileID:              lv.Fetcher.BlobFileID,
+			LongAttribute:           lv.Fetcher.LongAttribute,
+			LongAttributeConfigured: lv.Fetcher.LongAttributeConfigured,
 			// Not copying anything that has been extracted.
 		}
 		lvCopy.Fetcher = fetcher
@@ -271,3 +444,74 @@ func (e errValueFetcher) FetchHandle(
 	err = AssertionFailedf("unexpected blob value: %d-byte from %s", valLen, blobFileID)
 	return nil, false, err
 }
+
+// WithHandle implements base.ValueFetcher.
+func (e errValueFetcher) WithHandle(
+	_ context.Context, _ []byte, blobFileID BlobFileID, valLen uint32, _ func([]byte) error,
+) error {
+	return AssertionFailedf("unexpected blob value: %d-byte from %s", valLen, blobFileID)
+}
+
+// PrefetchHandles implements base.ValueFetcher.
+func (e errValueFetcher) PrefetchHandles(_ context.Context, reqs []PrefetchRequest) error {
+	if len(reqs) == 0 {
+		return nil
+	}
+	return AssertionFailedf("unexpected blob value: %d-byte from %s", reqs[0].ValueLen, reqs[0].BlobFileID)
+}
+
+// ErrLazyValueReentrantWithValue is returned by LazyValue.WithValue (and by
+// ValueFetcher.WithHandle implementations, by convention) when it is called
+// reentrantly: i.e. from within the callback of an outer, not-yet-returned
+// WithValue call using the same LazyFetcher.
+var ErrLazyValueReentrantWithValue = AssertionFailedf("pebble: reentrant call to LazyValue.WithValue")
+
+// LazyFetcherPool is a growable free list of LazyFetcher structs, for use
+// with LazyValue.Clone by an owner -- such as Iterator, or an
+// InternalIterator in the iterator tree -- that has a natural trigger for
+// reclaiming them: repositioning or closing. It replaces the hard-coded
+// array of K LazyFetchers that the Clone doc comment above describes, so
+// that callers like pebbleMVCCScanner are no longer limited to a fixed K.
+//
+// NB: this type is the reusable mechanism only. Wiring it up as
+// Iterator.AcquireFetcher(), with Reset called from the Iterator's
+// positioning and Close methods, belongs in the iterator tree and is not
+// part of this package.
+//
+// LazyFetcherPool is not safe for concurrent use.
+type LazyFetcherPool struct {
+	fetchers []*LazyFetcher
+	next     int
+}
+
+// Acquire returns a LazyFetcher for use as the fetcher argument to
+// LazyValue.Clone. The returned pointer is valid until the next call to
+// Reset.
+func (p *LazyFetcherPool) Acquire() *LazyFetcher {
+	if p.next == len(p.fetchers) {
+		p.fetchers = append(p.fetchers, &LazyFetcher{})
+	}
+	f := p.fetchers[p.next]
+	p.next++
+	return f
+}
+
+// Outstanding returns the number of LazyFetchers acquired since the last
+// Reset. It lets an owner's debug mode assert, before repositioning, that
+// the count it expects to have handed out (e.g. zero, if nothing should
+// have cloned a value this step) matches reality.
+func (p *LazyFetcherPool) Outstanding() int {
+	return p.next
+}
+
+// Reset reclaims all LazyFetchers acquired from the pool since the last
+// Reset, so that a subsequent Acquire can reuse them. The owner must call
+// Reset whenever it repositions or closes, since a LazyFetcher (and the
+// LazyValue.Clone that used it) is only as stable as the iterator position
+// that produced the value being cloned.
+func (p *LazyFetcherPool) Reset() {
+	for i := 0; i < p.next; i++ {
+		*p.fetchers[i] = LazyFetcher{}
+	}
+	p.next = 0
+}
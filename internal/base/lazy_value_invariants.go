@@ -0,0 +1,91 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+//go:build invariants
+
+package base
+
+import "context"
+
+// InvariantsEnabled is true in builds compiled with the invariants build
+// tag, i.e. the same builds in which the LazyValue poisoning below is
+// active.
+const InvariantsEnabled = true
+
+// StabilizeLazyValueForInvariants copies v.ValueOrHandle (a value, or a
+// handle if v.Fetcher is set) into a freshly allocated buffer and repoints
+// v.ValueOrHandle at the copy. It must be
+// called on every LazyValue as it is returned to a caller, before the
+// caller's next positioning call. This way, the subsequent call to
+// PoisonLazyValue below has a dedicated buffer to overwrite -- never the
+// live block or cache memory that v.ValueOrHandle would otherwise still be
+// aliasing, which other concurrent readers of that same cached block may
+// still be using. disabled mirrors the parameter on PoisonLazyValue, for
+// the same (documented) callers that opt out of this protection.
+func StabilizeLazyValueForInvariants(v *LazyValue, disabled bool) {
+	if disabled || len(v.ValueOrHandle) == 0 {
+		return
+	}
+	buf := make([]byte, len(v.ValueOrHandle))
+	copy(buf, v.ValueOrHandle)
+	v.ValueOrHandle = buf
+}
+
+// PoisonLazyValue overwrites v's ValueOrHandle with garbage and replaces its
+// Fetcher (if any) with one that panics on use, so that a caller holding
+// onto an unstable LazyValue.ValueOrHandle slice or LazyValue.Fetcher
+// pointer across a repositioning call gets a loud failure instead of a
+// silently stale or corrupted read. v.ValueOrHandle must already have been
+// stabilized into a dedicated, freshly allocated buffer by
+// StabilizeLazyValueForInvariants -- never a live block or cache slice --
+// since this call mutates it in place.
+//
+// This is the LazyValue-level building block for an invariants-build
+// InternalIterator wrapper that calls StabilizeLazyValueForInvariants on
+// every LazyValue it returns and PoisonLazyValue on the previously-returned
+// one as soon as it repositions (on each Next/Prev/Seek* call); it mirrors
+// the assertion-iterator pattern used by CockroachDB's pebbleiter, but lives
+// at Pebble's own layer so it also covers compactions, rangedel/rangekey
+// iterators, and mergingIter, which never pass through the public
+// pebble.Iterator. disabled allows a specific iterator instance to opt out,
+// for the (documented) callers that intentionally hold a LazyValue across a
+// reposition and manage its lifetime themselves.
+func PoisonLazyValue(v *LazyValue, disabled bool) {
+	if disabled {
+		return
+	}
+	if v.Fetcher != nil {
+		v.Fetcher = &LazyFetcher{Fetcher: poisonedValueFetcher{}}
+	}
+	for i := range v.ValueOrHandle {
+		v.ValueOrHandle[i] = 0xab
+	}
+}
+
+// poisonedValueFetcher panics on any use. It is substituted for the real
+// ValueFetcher inside a poisoned LazyFetcher so that using the LazyFetcher
+// after its owning iterator has been repositioned is caught immediately,
+// rather than racing with reused memory.
+type poisonedValueFetcher struct{}
+
+var _ ValueFetcher = poisonedValueFetcher{}
+
+// FetchHandle implements base.ValueFetcher.
+func (poisonedValueFetcher) FetchHandle(
+	context.Context, []byte, BlobFileID, uint32, []byte,
+) ([]byte, bool, error) {
+	panic("pebble: LazyValue used after owning iterator was repositioned")
+}
+
+// WithHandle implements base.ValueFetcher.
+func (poisonedValueFetcher) WithHandle(
+	context.Context, []byte, BlobFileID, uint32, func([]byte) error,
+) error {
+	panic("pebble: LazyValue used after owning iterator was repositioned")
+}
+
+// PrefetchHandles implements base.ValueFetcher.
+func (poisonedValueFetcher) PrefetchHandles(context.Context, []PrefetchRequest) error {
+	panic("pebble: LazyValue used after owning iterator was repositioned")
+}
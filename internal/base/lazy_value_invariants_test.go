@@ -0,0 +1,49 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+//go:build invariants
+
+package base
+
+import "testing"
+
+func TestStabilizeAndPoisonLazyValue(t *testing.T) {
+	shared := []byte("shared-block-bytes")
+	original := append([]byte(nil), shared...)
+
+	lv := LazyValue{ValueOrHandle: shared}
+	StabilizeLazyValueForInvariants(&lv, false)
+
+	// Stabilizing must copy into a new buffer, never alias the original.
+	if &lv.ValueOrHandle[0] == &shared[0] {
+		t.Fatalf("StabilizeLazyValueForInvariants did not copy into a fresh buffer")
+	}
+	if string(lv.ValueOrHandle) != string(original) {
+		t.Fatalf("got %q, want %q", lv.ValueOrHandle, original)
+	}
+
+	PoisonLazyValue(&lv, false)
+
+	// Poisoning must not touch the original, shared backing array.
+	if string(shared) != string(original) {
+		t.Fatalf("poisoning corrupted shared memory: got %q, want %q", shared, original)
+	}
+	for i, b := range lv.ValueOrHandle {
+		if b != 0xab {
+			t.Fatalf("byte %d not poisoned: got %x", i, b)
+		}
+	}
+
+	// disabled must skip both operations.
+	shared2 := []byte("other-shared-bytes")
+	lv2 := LazyValue{ValueOrHandle: shared2}
+	StabilizeLazyValueForInvariants(&lv2, true)
+	if &lv2.ValueOrHandle[0] != &shared2[0] {
+		t.Fatalf("disabled StabilizeLazyValueForInvariants should not have copied")
+	}
+	PoisonLazyValue(&lv2, true)
+	if string(shared2) != "other-shared-bytes" {
+		t.Fatalf("disabled PoisonLazyValue should not have mutated anything")
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+//go:build !invariants
+
+package base
+
+// InvariantsEnabled is true in builds compiled with the invariants build
+// tag. It is false here, where PoisonLazyValue is a no-op.
+const InvariantsEnabled = false
+
+// StabilizeLazyValueForInvariants is a no-op outside invariants builds; see
+// the invariants build version for what it does there.
+func StabilizeLazyValueForInvariants(v *LazyValue, disabled bool) {}
+
+// PoisonLazyValue is a no-op outside invariants builds; see the invariants
+// build version for what it does there.
+func PoisonLazyValue(v *LazyValue, disabled bool) {}
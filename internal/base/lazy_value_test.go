@@ -0,0 +1,214 @@
+// Copyright 2022 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package base
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTryGetLongAttribute(t *testing.T) {
+	// No Fetcher at all: in-place value, never configured.
+	lv := LazyValue{ValueOrHandle: []byte("foo")}
+	if attr, ok := lv.TryGetLongAttribute(); ok || attr != nil {
+		t.Fatalf("got (%v, %v), want (nil, false)", attr, ok)
+	}
+
+	// Fetcher present but no LongAttributeExtractor was configured for this
+	// sstable: must not be confused with a legitimately empty attribute.
+	lv = LazyValue{Fetcher: &LazyFetcher{}}
+	if attr, ok := lv.TryGetLongAttribute(); ok || attr != nil {
+		t.Fatalf("got (%v, %v), want (nil, false)", attr, ok)
+	}
+
+	// Extractor configured and ran, returning a non-empty attribute.
+	lv = LazyValue{Fetcher: &LazyFetcher{LongAttribute: LongAttribute("abc"), LongAttributeConfigured: true}}
+	if attr, ok := lv.TryGetLongAttribute(); !ok || string(attr) != "abc" {
+		t.Fatalf("got (%v, %v), want (\"abc\", true)", attr, ok)
+	}
+
+	// Extractor configured and ran, legitimately returning an empty
+	// attribute -- distinguishable from "never ran" via ok==true.
+	lv = LazyValue{Fetcher: &LazyFetcher{LongAttributeConfigured: true}}
+	if attr, ok := lv.TryGetLongAttribute(); !ok || attr != nil {
+		t.Fatalf("got (%v, %v), want (nil, true)", attr, ok)
+	}
+}
+
+func TestExtractLongAttribute(t *testing.T) {
+	// No extractor configured.
+	attr, configured, err := ExtractLongAttribute(nil, nil, 0, []byte("value"))
+	if err != nil || configured || attr != nil {
+		t.Fatalf("got (%v, %v, %v), want (nil, false, nil)", attr, configured, err)
+	}
+
+	// Extractor configured, within the length budget.
+	extractor := func(key []byte, keyPrefixLen int, value []byte) (LongAttribute, error) {
+		return LongAttribute(value[:1]), nil
+	}
+	attr, configured, err = ExtractLongAttribute(extractor, nil, 0, []byte("value"))
+	if err != nil || !configured || string(attr) != "v" {
+		t.Fatalf("got (%v, %v, %v), want (\"v\", true, nil)", attr, configured, err)
+	}
+
+	// Extractor returns an attribute exceeding MaxLongAttributeLen.
+	oversized := func(key []byte, keyPrefixLen int, value []byte) (LongAttribute, error) {
+		return make(LongAttribute, MaxLongAttributeLen+1), nil
+	}
+	_, configured, err = ExtractLongAttribute(oversized, nil, 0, []byte("value"))
+	if err == nil || !configured {
+		t.Fatalf("got (_, %v, %v), want (_, true, non-nil error)", configured, err)
+	}
+}
+
+// recordingValueFetcher returns a fixed value from FetchHandle and WithHandle.
+// The reentrancy guard is exercised by the test's own callbacks, which call
+// WithValue on the same LazyValue.
+type recordingValueFetcher struct {
+	val []byte
+}
+
+var _ ValueFetcher = recordingValueFetcher{}
+
+func (f recordingValueFetcher) FetchHandle(
+	context.Context, []byte, BlobFileID, uint32, []byte,
+) ([]byte, bool, error) {
+	return f.val, false, nil
+}
+
+func (f recordingValueFetcher) WithHandle(
+	_ context.Context, _ []byte, _ BlobFileID, _ uint32, fn func([]byte) error,
+) error {
+	return fn(f.val)
+}
+
+func (f recordingValueFetcher) PrefetchHandles(context.Context, []PrefetchRequest) error {
+	return nil
+}
+
+func TestLazyValueWithValue(t *testing.T) {
+	lv := LazyValue{
+		ValueOrHandle: []byte("handle"),
+		Fetcher: &LazyFetcher{
+			Fetcher:   recordingValueFetcher{val: []byte("bar")},
+			Attribute: AttributeAndLen{ValueLen: 3},
+		},
+	}
+
+	var got string
+	if err := lv.WithValue(context.Background(), func(val []byte) error {
+		got = string(val)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "bar" {
+		t.Fatalf("got %q, want %q", got, "bar")
+	}
+
+	// A reentrant WithValue call using the same LazyFetcher must be rejected
+	// rather than silently allowed to run concurrently with the outer call.
+	err := lv.WithValue(context.Background(), func([]byte) error {
+		return lv.WithValue(context.Background(), func([]byte) error { return nil })
+	})
+	if err != ErrLazyValueReentrantWithValue {
+		t.Fatalf("got %v, want ErrLazyValueReentrantWithValue", err)
+	}
+
+	// The guard must be released after a call returns, so a subsequent,
+	// non-reentrant call succeeds.
+	if err := lv.WithValue(context.Background(), func([]byte) error { return nil }); err != nil {
+		t.Fatalf("unexpected error after guard release: %v", err)
+	}
+}
+
+// panicValueFetcher fails the test if any fetch method is invoked; it is
+// used to confirm that a prefetched value short-circuits the real fetch.
+type panicValueFetcher struct{ t *testing.T }
+
+var _ ValueFetcher = panicValueFetcher{}
+
+func (f panicValueFetcher) FetchHandle(context.Context, []byte, BlobFileID, uint32, []byte) ([]byte, bool, error) {
+	f.t.Fatalf("FetchHandle should not be called when a prefetched value is set")
+	return nil, false, nil
+}
+
+func (f panicValueFetcher) WithHandle(context.Context, []byte, BlobFileID, uint32, func([]byte) error) error {
+	f.t.Fatalf("WithHandle should not be called when a prefetched value is set")
+	return nil
+}
+
+func (f panicValueFetcher) PrefetchHandles(context.Context, []PrefetchRequest) error {
+	return nil
+}
+
+func TestLazyFetcherSetPrefetched(t *testing.T) {
+	fetcher := &LazyFetcher{Fetcher: panicValueFetcher{t: t}, Attribute: AttributeAndLen{ValueLen: 3}}
+	fetcher.SetPrefetched([]byte("bar"))
+	lv := LazyValue{ValueOrHandle: []byte("handle"), Fetcher: fetcher}
+
+	val, callerOwned, err := lv.Value(nil)
+	if err != nil || callerOwned || string(val) != "bar" {
+		t.Fatalf("got (%q, %v, %v), want (\"bar\", false, nil)", val, callerOwned, err)
+	}
+
+	var got string
+	if err := lv.WithValue(context.Background(), func(val []byte) error {
+		got = string(val)
+		return nil
+	}); err != nil || got != "bar" {
+		t.Fatalf("got (%q, %v), want (\"bar\", nil)", got, err)
+	}
+}
+
+func TestLazyFetcherPool(t *testing.T) {
+	var p LazyFetcherPool
+	if n := p.Outstanding(); n != 0 {
+		t.Fatalf("got %d outstanding, want 0", n)
+	}
+
+	f1 := p.Acquire()
+	f2 := p.Acquire()
+	if f1 == f2 {
+		t.Fatalf("Acquire returned the same pointer twice without an intervening Reset")
+	}
+	if n := p.Outstanding(); n != 2 {
+		t.Fatalf("got %d outstanding, want 2", n)
+	}
+
+	f1.Attribute.ValueLen = 42
+	p.Reset()
+	if n := p.Outstanding(); n != 0 {
+		t.Fatalf("got %d outstanding after Reset, want 0", n)
+	}
+
+	// Acquire after Reset must reuse the same backing storage (so the pool
+	// stays allocation-free in steady state) but must have cleared any
+	// lingering state from the prior use.
+	f3 := p.Acquire()
+	if f3 != f1 {
+		t.Fatalf("Acquire after Reset did not reuse the freed LazyFetcher")
+	}
+	if f3.Attribute.ValueLen != 0 {
+		t.Fatalf("got ValueLen %d, want 0 (Reset should have cleared it)", f3.Attribute.ValueLen)
+	}
+
+	// Acquiring beyond the pool's current backing storage must grow it
+	// without invalidating previously returned pointers.
+	p.Reset()
+	held := make([]*LazyFetcher, 0, 8)
+	for i := 0; i < 8; i++ {
+		held = append(held, p.Acquire())
+	}
+	for i, f := range held {
+		f.Attribute.ValueLen = uint32(i + 1)
+	}
+	for i, f := range held {
+		if f.Attribute.ValueLen != uint32(i+1) {
+			t.Fatalf("fetcher %d was invalidated by pool growth: got ValueLen %d, want %d",
+				i, f.Attribute.ValueLen, i+1)
+		}
+	}
+}